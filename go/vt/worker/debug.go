@@ -0,0 +1,46 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/youtube/vitess/go/vt/worker/workerinfo"
+)
+
+// DebugWorkers is the payload served by DebugWorkersHandler: every job's
+// structured status plus every recurring schedule's run history.
+type DebugWorkers struct {
+	Jobs      []*JobStatus
+	Schedules []*ScheduleStatus
+}
+
+// DebugWorkersHandler is an http.HandlerFunc serving "/debug/workers": a
+// JSON dump of every job and schedule's structured status (see
+// workerinfo.Status), for the existing web UI page and for ad-hoc
+// debugging with curl.
+func (wi *Instance) DebugWorkersHandler(w http.ResponseWriter, r *http.Request) {
+	info := &DebugWorkers{
+		Jobs:      wi.List(),
+		Schedules: wi.Schedules(),
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(info); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// GetStatus returns the structured status of the job identified by jobID.
+// It's the implementation behind the gRPC vtworkerdata.GetStatus RPC; the
+// gRPC server wrapper (not present in this package) just needs to adapt
+// JobID/workerinfo.Status to the generated proto types.
+func (wi *Instance) GetStatus(jobID JobID) (*workerinfo.Status, error) {
+	status, err := wi.Status(jobID)
+	if err != nil {
+		return nil, err
+	}
+	return status.Info, nil
+}
@@ -0,0 +1,51 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"errors"
+
+	"google.golang.org/grpc/codes"
+)
+
+// Sentinel errors returned by Instance's job-lifecycle methods. Use
+// errors.Is to distinguish these expected, reentrant conditions (e.g. a
+// no-op Cancel on an already-finished job) from a genuine failure. See
+// GRPCCode for how the gRPC server should map them to status codes instead
+// of collapsing everything into codes.Internal.
+var (
+	// ErrWorkerAlreadyRunning is returned by setAndStartWorker once
+	// MaxConcurrentJobs running jobs are already in progress.
+	ErrWorkerAlreadyRunning = errors.New("a worker is already in progress")
+	// ErrNoWorker is returned by Cancel, Reset, Status and GetStatus when
+	// asked about a JobID that Instance doesn't know about, e.g. because it
+	// was never created or has since been garbage collected.
+	ErrNoWorker = errors.New("no worker job with that id")
+	// ErrWorkerCancelled is returned by Cancel when the job it's asked to
+	// cancel isn't running anymore, i.e. the cancellation is a no-op.
+	ErrWorkerCancelled = errors.New("worker job is not running, cannot cancel it")
+	// ErrWorkerAlreadyReset is returned by Reset when called a second time
+	// on the same job.
+	ErrWorkerAlreadyReset = errors.New("worker job has already been reset")
+)
+
+// GRPCCode maps one of the sentinel errors above to the gRPC status code
+// the vtworker gRPC server should return, instead of the generic
+// codes.Internal a plain fmt.Errorf would map to. Errors that don't match
+// any sentinel are left to the caller to map (typically to codes.Internal).
+func GRPCCode(err error) (codes.Code, bool) {
+	switch {
+	case errors.Is(err, ErrWorkerAlreadyRunning):
+		return codes.FailedPrecondition, true
+	case errors.Is(err, ErrNoWorker):
+		return codes.NotFound, true
+	case errors.Is(err, ErrWorkerCancelled):
+		return codes.FailedPrecondition, true
+	case errors.Is(err, ErrWorkerAlreadyReset):
+		return codes.FailedPrecondition, true
+	default:
+		return codes.Internal, false
+	}
+}
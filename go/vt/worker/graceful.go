@@ -0,0 +1,116 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+
+	log "github.com/golang/glog"
+)
+
+// listenFDsEnv, listenPIDEnv and listenReexecEnv implement the systemd socket-activation
+// protocol (LISTEN_FDS/LISTEN_PID), extended with one vtworker-specific
+// variable: systemd's parent always knows the child's pid before it execs
+// it, but a self-exec (our SIGHUP case) does not, so we have the child fix
+// up LISTEN_PID to its own pid immediately on startup. See
+// InheritedListener for the reading side of this protocol.
+const (
+	listenFDsEnv    = "LISTEN_FDS"
+	listenPIDEnv    = "LISTEN_PID"
+	listenReexecEnv = "VTWORKER_REEXEC"
+)
+
+// forkAndExec starts a new copy of the running vtworker binary, handing it
+// our listening socket (starting at fd 3) using the systemd socket
+// activation protocol. The new process can start serving immediately,
+// while this one keeps draining whatever jobs it still has in flight.
+func (wi *Instance) forkAndExec() error {
+	wi.mu.Lock()
+	l := wi.listener
+	wi.mu.Unlock()
+	if l == nil {
+		return fmt.Errorf("cannot restart: no listener registered, call SetListener first")
+	}
+
+	type fileListener interface {
+		File() (*os.File, error)
+	}
+	fl, ok := l.(fileListener)
+	if !ok {
+		return fmt.Errorf("cannot restart: listener of type %T does not support File()", l)
+	}
+	// File() returns a dup'd, blocking fd; it survives across exec because
+	// os.StartProcess below does not set FD_CLOEXEC on the Files it's given.
+	lf, err := fl.File()
+	if err != nil {
+		return fmt.Errorf("cannot dup listener fd: %v", err)
+	}
+	defer lf.Close()
+
+	argv0, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return fmt.Errorf("cannot resolve path to own executable %v: %v", os.Args[0], err)
+	}
+
+	env := append(os.Environ(),
+		listenFDsEnv+"=1",
+		// The real pid isn't known until after the child starts; it fixes
+		// LISTEN_PID up to match its own pid on startup, see
+		// listenReexecEnv above.
+		listenReexecEnv+"=1",
+	)
+
+	proc, err := os.StartProcess(argv0, os.Args, &os.ProcAttr{
+		Env:   env,
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr, lf},
+	})
+	if err != nil {
+		return fmt.Errorf("cannot fork/exec new vtworker: %v", err)
+	}
+	log.Infof("Forked vtworker pid %v to take over listener %v", proc.Pid, l.Addr())
+	return nil
+}
+
+// InheritedListener returns the net.Listener passed down to this process by
+// forkAndExec, if any. It should be called once, early in main(), before
+// the server starts listening on addr itself; callers typically do:
+//
+//	l, err := worker.InheritedListener()
+//	if err != nil {
+//	    return err
+//	}
+//	if l == nil {
+//	    l, err = net.Listen("tcp", addr)
+//	    ...
+//	}
+func InheritedListener() (net.Listener, error) {
+	if os.Getenv(listenReexecEnv) == "1" {
+		// We were forked by forkAndExec, which couldn't have known our pid
+		// in advance; claim the inherited fd as our own now that we do.
+		os.Setenv(listenPIDEnv, strconv.Itoa(os.Getpid()))
+	}
+	pid, err := strconv.Atoi(os.Getenv(listenPIDEnv))
+	if err != nil || pid != os.Getpid() {
+		// Nothing was handed down to us (e.g. normal startup, or socket
+		// activation meant for a different process).
+		return nil, nil
+	}
+	nfds, err := strconv.Atoi(os.Getenv(listenFDsEnv))
+	if err != nil || nfds < 1 {
+		return nil, fmt.Errorf("invalid %v=%q", listenFDsEnv, os.Getenv(listenFDsEnv))
+	}
+	// fd 3 is the first non-stdio fd by convention.
+	f := os.NewFile(uintptr(3), "vtworker-inherited-listener")
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("cannot build listener from inherited fd 3: %v", err)
+	}
+	f.Close()
+	return l, nil
+}
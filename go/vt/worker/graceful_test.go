@@ -0,0 +1,122 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// withFakeExit swaps exitFunc for one that records calls instead of killing
+// the test binary, and returns the recorded-exit-codes channel plus a
+// restore func.
+func withFakeExit(t *testing.T) (exits chan int, restore func()) {
+	t.Helper()
+	real := exitFunc
+	exits = make(chan int, 4)
+	exitFunc = func(code int) { exits <- code }
+	return exits, func() { exitFunc = real }
+}
+
+// stuckWorker ignores context cancellation entirely: its Run only returns
+// once release is closed, so a drain waiting on it ends either when the test
+// closes release or when beginDrain's hammer-time timeout expires.
+type stuckWorker struct {
+	release chan struct{}
+}
+
+func newStuckWorker() *stuckWorker {
+	return &stuckWorker{release: make(chan struct{})}
+}
+
+func (w *stuckWorker) Run(ctx context.Context) error {
+	<-w.release
+	return nil
+}
+
+func TestBeginDrain_IdleExitsImmediately(t *testing.T) {
+	wi := newTestInstance()
+	exits, restore := withFakeExit(t)
+	defer restore()
+
+	wi.beginDrain(false)
+
+	select {
+	case code := <-exits:
+		if code != 0 {
+			t.Fatalf("expected exit code 0 for an idle drain, got %v", code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("beginDrain on an idle Instance never called exitFunc")
+	}
+}
+
+func TestBeginDrain_WaitsForInFlightJobsThenExits(t *testing.T) {
+	wi := newTestInstance()
+	exits, restore := withFakeExit(t)
+	defer restore()
+
+	wrk := newStuckWorker()
+	_, done := startFakeJob(t, wi, wrk)
+
+	wi.beginDrain(false)
+
+	draining, _, restarting := wi.DrainStatus()
+	if !draining || restarting {
+		t.Fatalf("DrainStatus() = draining=%v, restarting=%v; want draining=true, restarting=false", draining, restarting)
+	}
+
+	select {
+	case <-exits:
+		t.Fatal("beginDrain exited before its cancelled job finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// stuckWorker.Run ignores the cancellation beginDrain sent it, so the
+	// drain is still waiting on j.done until the worker is released here.
+	close(wrk.release)
+	<-done
+
+	select {
+	case code := <-exits:
+		if code != 0 {
+			t.Fatalf("expected exit code 0 once jobs drained, got %v", code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("beginDrain never exited after its jobs finished")
+	}
+}
+
+func TestBeginDrain_HammerTimeForcesExit(t *testing.T) {
+	wi := newTestInstance()
+	wi.HammerTime = 10 * time.Millisecond
+	exits, restore := withFakeExit(t)
+	defer restore()
+
+	wrk := newStuckWorker()
+	defer close(wrk.release)
+	startFakeJob(t, wi, wrk)
+
+	wi.beginDrain(true)
+
+	select {
+	case code := <-exits:
+		if code != 0 {
+			t.Fatalf("expected exit code 0 on hammer-time expiry, got %v", code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("beginDrain never forced an exit once HammerTime expired")
+	}
+
+	draining, remaining, restarting := wi.DrainStatus()
+	if !draining || !restarting {
+		t.Fatalf("DrainStatus() = draining=%v, restarting=%v; want both true", draining, restarting)
+	}
+	if remaining < 0 {
+		t.Fatalf("DrainStatus() remaining = %v, want >= 0", remaining)
+	}
+}
@@ -5,10 +5,13 @@
 package worker
 
 import (
+	"encoding/json"
 	"fmt"
+	"net"
 	"os"
 	"os/signal"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -16,31 +19,127 @@ import (
 	"github.com/youtube/vitess/go/vt/logutil"
 	"github.com/youtube/vitess/go/vt/tabletmanager/tmclient"
 	"github.com/youtube/vitess/go/vt/topo"
+	"github.com/youtube/vitess/go/vt/worker/workerinfo"
 	"github.com/youtube/vitess/go/vt/wrangler"
 	"golang.org/x/net/context"
 )
 
+// JobID identifies a single worker run tracked by an Instance. It is opaque
+// to callers and should only be compared for equality or round-tripped
+// through the RPC/HTTP frontends.
+type JobID string
+
+// jobIDGenerator hands out monotonically increasing JobIDs. It is package
+// level (rather than per-Instance) so IDs stay unique even across Instances
+// created within the same process, e.g. in tests.
+var jobIDGenerator uint64
+
+func newJobID() JobID {
+	return JobID(fmt.Sprintf("%d", atomic.AddUint64(&jobIDGenerator, 1)))
+}
+
+// exitFunc is os.Exit, indirected so tests can exercise beginDrain's
+// shutdown decisions (idle exit, drained, hammer-time) without killing the
+// test binary.
+var exitFunc = os.Exit
+
+// job bundles all the state that setAndStartWorker needs to keep track of
+// for a single Worker run.
+type job struct {
+	id           JobID
+	wrk          Worker
+	memoryLogger *logutil.MemoryLogger
+	ctx          context.Context
+	cancel       context.CancelFunc
+	// reporter is the structured-status handle handed to wrk, if it knows
+	// how to use one. See workerReporter below.
+	reporter *workerinfo.StatusReporter
+	// done is closed once the worker's Run method has returned.
+	done chan struct{}
+	// lastRunError is nil while the job is running, and holds the result of
+	// wrk.Run() once it completes.
+	lastRunError error
+
+	startTime time.Time
+	endTime   time.Time
+}
+
+// running returns true if the job has not completed yet.
+func (j *job) running() bool {
+	return j.cancel != nil
+}
+
+// workerReporter is implemented by Worker implementations that publish
+// structured status through a workerinfo.StatusReporter rather than (or in
+// addition to) free-form log lines. It's an optional interface: Workers
+// that don't implement it simply don't get one wired up.
+type workerReporter interface {
+	SetStatusReporter(r *workerinfo.StatusReporter)
+}
+
 // Instance encapsulate the execution state of vtworker.
 type Instance struct {
 	// Default wrangler for all operations.
 	// Users can specify their own in RunCommand() e.g. the gRPC server does this.
 	wr *wrangler.Wrangler
 
-	// mutex is protecting all the following variables
-	// 3 states here:
-	// - no job ever ran (or reset was run): currentWorker is nil,
-	// currentContext/currentCancelFunc is nil, lastRunError is nil
-	// - one worker running: currentWorker is set,
-	//   currentContext/currentCancelFunc is set, lastRunError is nil
-	// - (at least) one worker already ran, none is running atm:
-	//   currentWorker is set, currentContext is nil, lastRunError
-	//   has the error returned by the worker.
-	currentWorkerMutex  sync.Mutex
-	currentWorker       Worker
-	currentMemoryLogger *logutil.MemoryLogger
-	currentContext      context.Context
-	currentCancelFunc   context.CancelFunc
-	lastRunError        error
+	// mu protects the fields below, in particular the jobs registry.
+	mu sync.Mutex
+	// jobs holds every job we still remember, keyed by JobID. Entries are
+	// removed by gcJobsLocked once they are done and exceed
+	// MaxCompletedJobs/CompletedJobTTL.
+	jobs order
+	// numRunning is the number of jobs currently in progress. It's kept in
+	// sync with the number of jobs whose running() is true, and checked
+	// against MaxConcurrentJobs.
+	numRunning int
+	// schedules holds every recurring schedule registered via Schedule(),
+	// keyed by ScheduleID.
+	schedules map[ScheduleID]*schedule
+
+	// resetJobs remembers, in insertion order, the JobIDs Reset() has
+	// forgotten, so a second Reset() call on the same jobID can return
+	// ErrWorkerAlreadyReset instead of the ErrNoWorker a jobID that never
+	// existed would get. Bounded to resetJobsLimit entries so it can't grow
+	// without bound; beyond that we'd rather fall back to ErrNoWorker for
+	// an old jobID than keep every one ever issued.
+	resetJobs     map[JobID]time.Time
+	resetJobOrder []JobID
+
+	// MaxConcurrentJobs caps how many workers this Instance will run at the
+	// same time. Defaults to 1 in NewInstance to preserve the historical
+	// single-worker-at-a-time behavior.
+	MaxConcurrentJobs int
+	// MaxCompletedJobs bounds how many finished jobs are kept around for
+	// Status()/List() lookups. The oldest completed job is evicted once the
+	// limit is exceeded. Zero means unlimited.
+	MaxCompletedJobs int
+	// CompletedJobTTL, when non-zero, evicts a completed job once it has
+	// been done for longer than this, independent of MaxCompletedJobs.
+	// Expiry is only checked when a job completes, so an expired job stays
+	// visible to Status()/List() until the next job finishes.
+	CompletedJobTTL time.Duration
+
+	// HammerTime bounds how long InstallSignalHandlers will wait, after the
+	// first SIGTERM/SIGINT, for in-flight jobs to finish before forcing the
+	// process to exit. A second signal forces an immediate exit regardless.
+	// Defaults to 60s in NewInstance.
+	HammerTime time.Duration
+
+	// StallTimeout is passed to each job's workerinfo.StatusReporter: if a
+	// worker doesn't call Heartbeat() (directly, or indirectly via
+	// SetStage/SetProgress) within this long, its status is reported as
+	// stalled. Zero disables stall detection.
+	StallTimeout time.Duration
+
+	// listener is the socket vtworker's gRPC/HTTP server is listening on.
+	// It is set via SetListener by the server bootstrap code, and is only
+	// used to hand the socket to a freshly forked process on SIGHUP.
+	listener net.Listener
+	// drain is non-nil from the moment the first shutdown signal arrives
+	// until the process exits; Status() reports it so operators can see
+	// e.g. "draining, 42s remaining".
+	drain *drainState
 
 	topoServer             topo.Server
 	cell                   string
@@ -48,9 +147,74 @@ type Instance struct {
 	commandDisplayInterval time.Duration
 }
 
+// drainState records the state of an in-progress graceful shutdown/restart.
+type drainState struct {
+	deadline   time.Time
+	restarting bool
+}
+
+// DrainStatus reports whether the Instance is currently draining in-flight
+// jobs ahead of a shutdown or SIGHUP-triggered restart, and if so, how much
+// longer it will wait before forcing an exit.
+func (wi *Instance) DrainStatus() (draining bool, remaining time.Duration, restarting bool) {
+	wi.mu.Lock()
+	defer wi.mu.Unlock()
+	if wi.drain == nil {
+		return false, 0, false
+	}
+	remaining = wi.drain.deadline.Sub(time.Now())
+	if remaining < 0 {
+		remaining = 0
+	}
+	return true, remaining, wi.drain.restarting
+}
+
+// SetListener registers the socket the gRPC/HTTP server is listening on.
+// It must be called before InstallSignalHandlers can honor SIGHUP restarts.
+func (wi *Instance) SetListener(l net.Listener) {
+	wi.mu.Lock()
+	defer wi.mu.Unlock()
+	wi.listener = l
+}
+
+// order is a small helper that keeps jobs in both a map (for lookup by
+// JobID) and a slice (to remember insertion order for List() and GC).
+type order struct {
+	byID  map[JobID]*job
+	order []JobID
+}
+
+func newOrder() order {
+	return order{byID: make(map[JobID]*job)}
+}
+
+func (o *order) add(j *job) {
+	o.byID[j.id] = j
+	o.order = append(o.order, j.id)
+}
+
+func (o *order) remove(id JobID) {
+	delete(o.byID, id)
+	for i, existing := range o.order {
+		if existing == id {
+			o.order = append(o.order[:i], o.order[i+1:]...)
+			break
+		}
+	}
+}
+
 // NewInstance creates a new Instance.
 func NewInstance(ts topo.Server, cell string, lockTimeout, commandDisplayInterval time.Duration) *Instance {
-	wi := &Instance{topoServer: ts, cell: cell, commandDisplayInterval: commandDisplayInterval}
+	wi := &Instance{
+		topoServer:             ts,
+		cell:                   cell,
+		lockTimeout:            lockTimeout,
+		commandDisplayInterval: commandDisplayInterval,
+		jobs:                   newOrder(),
+		resetJobs:              make(map[JobID]time.Time),
+		MaxConcurrentJobs:      1,
+		HammerTime:             60 * time.Second,
+	}
 	// Note: setAndStartWorker() also adds a MemoryLogger for the webserver.
 	wi.wr = wi.CreateWrangler(logutil.NewConsoleLogger())
 	return wi
@@ -61,61 +225,304 @@ func (wi *Instance) CreateWrangler(logger logutil.Logger) *wrangler.Wrangler {
 	return wrangler.New(logger, wi.topoServer, tmclient.NewTabletManagerClient(), wi.lockTimeout)
 }
 
-// setAndStartWorker will set the current worker.
-// We always log to both memory logger (for display on the web) and
-// console logger (for records / display of command line worker).
-func (wi *Instance) setAndStartWorker(wrk Worker, wr *wrangler.Wrangler) (chan struct{}, error) {
-	wi.currentWorkerMutex.Lock()
-	defer wi.currentWorkerMutex.Unlock()
-	if wi.currentWorker != nil {
-		return nil, fmt.Errorf("A worker is already in progress: %v", wi.currentWorker)
+// setAndStartWorker builds a Worker via newWorker and starts running it in
+// the background as a new job. It returns the JobID that future
+// Cancel/Reset/Status/List calls should use to refer to this run.
+//
+// wr is the wrangler newWorker's Worker will be built with. Every
+// concurrent job needs its own *wrangler.Wrangler: below, we call
+// wr.SetLogger to tee the worker's log lines into its own MemoryLogger, and
+// that mutates wr in place, so two jobs sharing one wrangler would race on
+// SetLogger and end up cross-attributing each other's log lines. If wr is
+// the Instance's shared default (wi.wr), we transparently swap in a fresh
+// one from CreateWrangler and build the worker with that instead, so the
+// shared default is never mutated.
+func (wi *Instance) setAndStartWorker(newWorker func(wr *wrangler.Wrangler) Worker, wr *wrangler.Wrangler) (JobID, chan struct{}, error) {
+	wi.mu.Lock()
+	defer wi.mu.Unlock()
+
+	if wi.numRunning >= wi.MaxConcurrentJobs {
+		return "", nil, fmt.Errorf("%w: %v other job(s) already running, limit is %v", ErrWorkerAlreadyRunning, wi.numRunning, wi.MaxConcurrentJobs)
 	}
 
-	wi.currentWorker = wrk
-	wi.currentMemoryLogger = logutil.NewMemoryLogger()
-	wi.currentContext, wi.currentCancelFunc = context.WithCancel(context.Background())
-	wi.lastRunError = nil
-	done := make(chan struct{})
-	wranglerLogger := wr.Logger()
 	if wr == wi.wr {
-		// If it's the default wrangler, do not reuse its logger because it may have been set before.
-		// Resuing it would result into an endless recursion.
-		wranglerLogger = logutil.NewConsoleLogger()
+		wr = wi.CreateWrangler(wr.Logger())
 	}
-	wr.SetLogger(logutil.NewTeeLogger(wi.currentMemoryLogger, wranglerLogger))
+	wrk := newWorker(wr)
+
+	j := &job{
+		id:           newJobID(),
+		wrk:          wrk,
+		memoryLogger: logutil.NewMemoryLogger(),
+		reporter:     workerinfo.New(wi.StallTimeout),
+		done:         make(chan struct{}),
+		startTime:    time.Now(),
+	}
+	j.ctx, j.cancel = context.WithCancel(context.Background())
+	if reporting, ok := wrk.(workerReporter); ok {
+		reporting.SetStatusReporter(j.reporter)
+	}
+	wi.jobs.add(j)
+	wi.numRunning++
+
+	wr.SetLogger(logutil.NewTeeLogger(j.memoryLogger, wr.Logger()))
 
 	// one go function runs the worker, changes state when done
 	go func() {
 		// run will take a long time
-		log.Infof("Starting worker...")
-		err := wrk.Run(wi.currentContext)
+		log.Infof("Starting worker %v...", j.id)
+		err := wrk.Run(j.ctx)
 
 		// it's done, let's save our state
-		wi.currentWorkerMutex.Lock()
-		wi.currentContext = nil
-		wi.currentCancelFunc = nil
-		wi.lastRunError = err
-		wi.currentWorkerMutex.Unlock()
-		close(done)
+		wi.mu.Lock()
+		j.cancel = nil
+		j.ctx = nil
+		j.lastRunError = err
+		j.endTime = time.Now()
+		wi.numRunning--
+		wi.gcJobsLocked()
+		wi.mu.Unlock()
+		close(j.done)
 	}()
 
-	return done, nil
+	return j.id, j.done, nil
+}
+
+// gcJobsLocked evicts completed jobs once they exceed MaxCompletedJobs or
+// CompletedJobTTL. Callers must hold wi.mu.
+func (wi *Instance) gcJobsLocked() {
+	now := time.Now()
+	kept := 0
+	// Walk newest-first in start (insertion) order, so we keep the most
+	// recently started of the completed jobs and evict the older ones once
+	// MaxCompletedJobs is exceeded.
+	ids := append([]JobID{}, wi.jobs.order...)
+	for i := len(ids) - 1; i >= 0; i-- {
+		id := ids[i]
+		j := wi.jobs.byID[id]
+		if j.running() {
+			continue
+		}
+		kept++
+		expired := wi.CompletedJobTTL > 0 && now.Sub(j.endTime) > wi.CompletedJobTTL
+		overLimit := wi.MaxCompletedJobs > 0 && kept > wi.MaxCompletedJobs
+		if expired || overLimit {
+			wi.jobs.remove(id)
+		}
+	}
+}
+
+// resetJobsLimit bounds how many forgotten JobIDs Reset() remembers, so a
+// caller who keeps issuing and resetting jobs can't grow wi.resetJobs
+// without bound.
+const resetJobsLimit = 1000
+
+// rememberResetLocked records that jobID has been forgotten by Reset(), so
+// a repeat Reset() call on it returns ErrWorkerAlreadyReset. Callers must
+// hold wi.mu.
+func (wi *Instance) rememberResetLocked(jobID JobID) {
+	wi.resetJobs[jobID] = time.Now()
+	wi.resetJobOrder = append(wi.resetJobOrder, jobID)
+	if len(wi.resetJobOrder) > resetJobsLimit {
+		oldest := wi.resetJobOrder[0]
+		wi.resetJobOrder = wi.resetJobOrder[1:]
+		delete(wi.resetJobs, oldest)
+	}
+}
+
+// Cancel cancels the job identified by jobID, if it is still running.
+func (wi *Instance) Cancel(jobID JobID) error {
+	wi.mu.Lock()
+	defer wi.mu.Unlock()
+	j, ok := wi.jobs.byID[jobID]
+	if !ok {
+		return fmt.Errorf("%w: %v", ErrNoWorker, jobID)
+	}
+	if !j.running() {
+		return fmt.Errorf("%w: job %v", ErrWorkerCancelled, jobID)
+	}
+	j.cancel()
+	return nil
+}
+
+// Reset forgets about the job identified by jobID, same as the original
+// single-worker Reset() did: once it returns, List()/Status() stop
+// returning jobID at all. It fails if the job is still running (a finished
+// job already stopped counting against MaxConcurrentJobs when it completed). Calling it again on the
+// same jobID (now forgotten) returns ErrWorkerAlreadyReset rather than the
+// ErrNoWorker a never-issued jobID would get, for as long as it's
+// remembered in wi.resetJobs (see rememberResetLocked).
+func (wi *Instance) Reset(jobID JobID) error {
+	wi.mu.Lock()
+	defer wi.mu.Unlock()
+	j, ok := wi.jobs.byID[jobID]
+	if !ok {
+		if _, wasReset := wi.resetJobs[jobID]; wasReset {
+			return fmt.Errorf("%w: %v", ErrWorkerAlreadyReset, jobID)
+		}
+		return fmt.Errorf("%w: %v", ErrNoWorker, jobID)
+	}
+	if j.running() {
+		return fmt.Errorf("%w: job %v is still running", ErrWorkerAlreadyRunning, jobID)
+	}
+	wi.jobs.remove(jobID)
+	wi.rememberResetLocked(jobID)
+	return nil
+}
+
+// JobStatus is a point-in-time snapshot of a job's state, returned by
+// Status() and List().
+type JobStatus struct {
+	ID        JobID
+	Running   bool
+	StartTime time.Time
+	EndTime   time.Time
+	Error     error
+	// Log is the in-memory record of everything the job has logged so far.
+	// Callers that need the text (e.g. the web UI) can format it themselves.
+	Log *logutil.MemoryLogger
+	// Info is the job's structured status, as published by the worker
+	// itself through a workerinfo.StatusReporter (see workerReporter).
+	Info *workerinfo.Status
+}
+
+// MarshalJSON renders Error as a plain string. The error interface's
+// concrete types (errors.errorString, fmt.wrapError, ...) have no exported
+// fields, so encoding/json would otherwise silently serialize a non-nil
+// Error as "{}", which is exactly the failure reason an operator hitting
+// the /debug/workers endpoint most wants to see.
+func (js *JobStatus) MarshalJSON() ([]byte, error) {
+	type jobStatusAlias JobStatus
+	aux := struct {
+		*jobStatusAlias
+		Error string `json:",omitempty"`
+	}{jobStatusAlias: (*jobStatusAlias)(js)}
+	if js.Error != nil {
+		aux.Error = js.Error.Error()
+	}
+	return json.Marshal(aux)
+}
+
+// Status returns a snapshot of the job identified by jobID.
+func (wi *Instance) Status(jobID JobID) (*JobStatus, error) {
+	wi.mu.Lock()
+	defer wi.mu.Unlock()
+	j, ok := wi.jobs.byID[jobID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", ErrNoWorker, jobID)
+	}
+	return wi.statusLocked(j), nil
 }
 
-// InstallSignalHandlers installs signal handler which exit vtworker gracefully.
+// List returns a snapshot of every job the Instance still remembers, oldest
+// first.
+func (wi *Instance) List() []*JobStatus {
+	wi.mu.Lock()
+	defer wi.mu.Unlock()
+	statuses := make([]*JobStatus, 0, len(wi.jobs.order))
+	for _, id := range wi.jobs.order {
+		statuses = append(statuses, wi.statusLocked(wi.jobs.byID[id]))
+	}
+	return statuses
+}
+
+// statusLocked builds a JobStatus for j. Callers must hold wi.mu.
+func (wi *Instance) statusLocked(j *job) *JobStatus {
+	return &JobStatus{
+		ID:        j.id,
+		Running:   j.running(),
+		StartTime: j.startTime,
+		EndTime:   j.endTime,
+		Error:     j.lastRunError,
+		Log:       j.memoryLogger,
+		Info:      j.reporter.Snapshot(),
+	}
+}
+
+// InstallSignalHandlers installs a signal handler implementing a two-phase
+// graceful shutdown, modeled after the approach used by gitea for graceful
+// restarts:
+//   - the first SIGTERM/SIGINT cancels every in-flight job and starts a
+//     bounded drain: we wait up to HammerTime for all of them to finish.
+//   - a second SIGTERM/SIGINT, or the hammer timer expiring first, forces
+//     an immediate os.Exit.
+//   - SIGHUP forks and execs a new vtworker that inherits our listening
+//     socket (see forkAndExec), then begins draining this process exactly
+//     like SIGTERM/SIGINT above, so the new process takes over serving
+//     while any jobs we still have in flight finish or get cancelled.
 func (wi *Instance) InstallSignalHandlers() {
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
+	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	go func() {
+		for s := range sigChan {
+			wi.mu.Lock()
+			alreadyDraining := wi.drain != nil
+			wi.mu.Unlock()
+
+			if s == syscall.SIGHUP {
+				if alreadyDraining {
+					// Already draining or restarting: a second SIGHUP must
+					// not fork a second child that races the first one for
+					// the same listener fd.
+					fmt.Printf("Ignoring SIGHUP, already draining/restarting\n")
+					continue
+				}
+				if err := wi.forkAndExec(); err != nil {
+					log.Errorf("SIGHUP restart failed, continuing to serve: %v", err)
+					continue
+				}
+				wi.beginDrain(true)
+				continue
+			}
+
+			// SIGTERM or SIGINT.
+			if alreadyDraining {
+				fmt.Printf("Received second shutdown signal %v, exiting immediately\n", s)
+				exitFunc(1)
+			}
+			wi.beginDrain(false)
+		}
+	}()
+}
+
+// beginDrain cancels every running job and waits up to HammerTime for them
+// to finish before forcing os.Exit. It returns immediately; the wait
+// happens on its own goroutine so the signal handler keeps listening for a
+// second signal.
+func (wi *Instance) beginDrain(restarting bool) {
+	wi.mu.Lock()
+	wi.drain = &drainState{deadline: time.Now().Add(wi.HammerTime), restarting: restarting}
+	dones := make([]chan struct{}, 0, len(wi.jobs.order))
+	for _, id := range wi.jobs.order {
+		j := wi.jobs.byID[id]
+		if j.running() {
+			j.cancel()
+			dones = append(dones, j.done)
+		}
+	}
+	if len(dones) == 0 {
+		wi.mu.Unlock()
+		fmt.Println("Shutting down idle worker")
+		exitFunc(0)
+		return
+	}
+	hammerTime := wi.HammerTime
+	wi.mu.Unlock()
+
 	go func() {
-		s := <-sigChan
-		// we got a signal, notify our modules
-		wi.currentWorkerMutex.Lock()
-		defer wi.currentWorkerMutex.Unlock()
-		if wi.currentCancelFunc != nil {
-			wi.currentCancelFunc()
-		} else {
-			fmt.Printf("Shutting down idle worker after receiving signal: %v", s)
-			os.Exit(0)
+		drained := make(chan struct{})
+		go func() {
+			for _, done := range dones {
+				<-done
+			}
+			close(drained)
+		}()
+		select {
+		case <-drained:
+			fmt.Println("All in-flight jobs finished, shutting down")
+		case <-time.After(hammerTime):
+			fmt.Printf("Hammer time (%v) expired with jobs still running, forcing shutdown\n", hammerTime)
 		}
+		exitFunc(0)
 	}()
 }
@@ -0,0 +1,193 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/youtube/vitess/go/vt/wrangler"
+	"golang.org/x/net/context"
+)
+
+// fakeWorker is a minimal Worker used by the tests in this package: it
+// blocks until either its done channel is closed (simulating a successful
+// run) or its context is cancelled.
+type fakeWorker struct {
+	done chan struct{}
+}
+
+func newFakeWorker() *fakeWorker {
+	return &fakeWorker{done: make(chan struct{})}
+}
+
+func (f *fakeWorker) Run(ctx context.Context) error {
+	select {
+	case <-f.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func newTestInstance() *Instance {
+	wi := NewInstance(nil, "test", time.Second, time.Second)
+	wi.MaxConcurrentJobs = 2
+	return wi
+}
+
+func startFakeJob(t *testing.T, wi *Instance, wrk Worker) (JobID, chan struct{}) {
+	t.Helper()
+	jobID, done, err := wi.setAndStartWorker(func(wr *wrangler.Wrangler) Worker { return wrk }, wi.wr)
+	if err != nil {
+		t.Fatalf("setAndStartWorker failed: %v", err)
+	}
+	return jobID, done
+}
+
+func TestSetAndStartWorker_ConcurrencyLimit(t *testing.T) {
+	wi := newTestInstance()
+	wi.MaxConcurrentJobs = 1
+
+	blocking := newFakeWorker()
+	if _, _, err := wi.setAndStartWorker(func(wr *wrangler.Wrangler) Worker { return blocking }, wi.wr); err != nil {
+		t.Fatalf("first job should have started: %v", err)
+	}
+
+	_, _, err := wi.setAndStartWorker(func(wr *wrangler.Wrangler) Worker { return newFakeWorker() }, wi.wr)
+	if !errors.Is(err, ErrWorkerAlreadyRunning) {
+		t.Fatalf("expected ErrWorkerAlreadyRunning, got %v", err)
+	}
+
+	close(blocking.done)
+}
+
+func TestSetAndStartWorker_EachJobGetsItsOwnWrangler(t *testing.T) {
+	wi := newTestInstance()
+
+	seen := make(chan *wrangler.Wrangler, 2)
+	newWorker := func(wr *wrangler.Wrangler) Worker {
+		if wr == wi.wr {
+			t.Errorf("job was handed the shared default wrangler directly")
+		}
+		seen <- wr
+		return newFakeWorker()
+	}
+
+	w1 := newFakeWorker()
+	w2 := newFakeWorker()
+	if _, _, err := wi.setAndStartWorker(func(wr *wrangler.Wrangler) Worker { newWorker(wr); return w1 }, wi.wr); err != nil {
+		t.Fatalf("job 1 failed to start: %v", err)
+	}
+	if _, _, err := wi.setAndStartWorker(func(wr *wrangler.Wrangler) Worker { newWorker(wr); return w2 }, wi.wr); err != nil {
+		t.Fatalf("job 2 failed to start: %v", err)
+	}
+	_ = newWorker
+
+	first := <-seen
+	second := <-seen
+	if first == second {
+		t.Fatalf("two concurrent jobs using the default wrangler were given the same *wrangler.Wrangler")
+	}
+	close(w1.done)
+	close(w2.done)
+}
+
+func TestCancel(t *testing.T) {
+	wi := newTestInstance()
+
+	t.Run("unknown job", func(t *testing.T) {
+		if err := wi.Cancel("bogus"); !errors.Is(err, ErrNoWorker) {
+			t.Fatalf("expected ErrNoWorker, got %v", err)
+		}
+	})
+
+	t.Run("running job", func(t *testing.T) {
+		wrk := newFakeWorker()
+		jobID, done := startFakeJob(t, wi, wrk)
+		if err := wi.Cancel(jobID); err != nil {
+			t.Fatalf("Cancel failed: %v", err)
+		}
+		<-done
+		status, err := wi.Status(jobID)
+		if err != nil {
+			t.Fatalf("Status failed: %v", err)
+		}
+		if !errors.Is(status.Error, context.Canceled) {
+			t.Fatalf("expected job error to be context.Canceled, got %v", status.Error)
+		}
+	})
+
+	t.Run("already finished job", func(t *testing.T) {
+		wrk := newFakeWorker()
+		jobID, done := startFakeJob(t, wi, wrk)
+		close(wrk.done)
+		<-done
+		if err := wi.Cancel(jobID); !errors.Is(err, ErrWorkerCancelled) {
+			t.Fatalf("expected ErrWorkerCancelled, got %v", err)
+		}
+	})
+}
+
+func TestReset(t *testing.T) {
+	wi := newTestInstance()
+
+	t.Run("running job", func(t *testing.T) {
+		wrk := newFakeWorker()
+		jobID, done := startFakeJob(t, wi, wrk)
+		if err := wi.Reset(jobID); !errors.Is(err, ErrWorkerAlreadyRunning) {
+			t.Fatalf("expected ErrWorkerAlreadyRunning, got %v", err)
+		}
+		close(wrk.done)
+		<-done
+	})
+
+	t.Run("forgets the job and is idempotent-error on repeat", func(t *testing.T) {
+		wrk := newFakeWorker()
+		jobID, done := startFakeJob(t, wi, wrk)
+		close(wrk.done)
+		<-done
+
+		if err := wi.Reset(jobID); err != nil {
+			t.Fatalf("first Reset failed: %v", err)
+		}
+		if _, err := wi.Status(jobID); !errors.Is(err, ErrNoWorker) {
+			t.Fatalf("Status after Reset should report ErrNoWorker, got %v", err)
+		}
+		if err := wi.Reset(jobID); !errors.Is(err, ErrWorkerAlreadyReset) {
+			t.Fatalf("second Reset should report ErrWorkerAlreadyReset, got %v", err)
+		}
+	})
+
+	t.Run("unknown job", func(t *testing.T) {
+		if err := wi.Reset("bogus"); !errors.Is(err, ErrNoWorker) {
+			t.Fatalf("expected ErrNoWorker, got %v", err)
+		}
+	})
+}
+
+func TestGCEvictsOldestCompletedJobs(t *testing.T) {
+	wi := newTestInstance()
+	wi.MaxConcurrentJobs = 1
+	wi.MaxCompletedJobs = 1
+
+	var ids []JobID
+	for i := 0; i < 2; i++ {
+		wrk := newFakeWorker()
+		jobID, done := startFakeJob(t, wi, wrk)
+		close(wrk.done)
+		<-done
+		ids = append(ids, jobID)
+	}
+
+	statuses := wi.List()
+	if len(statuses) != 1 {
+		t.Fatalf("expected 1 job to survive GC, got %d", len(statuses))
+	}
+	if statuses[0].ID != ids[len(ids)-1] {
+		t.Fatalf("expected the most recent job %v to survive, got %v", ids[len(ids)-1], statuses[0].ID)
+	}
+}
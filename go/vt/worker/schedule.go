@@ -0,0 +1,295 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/youtube/vitess/go/vt/wrangler"
+	"golang.org/x/net/context"
+)
+
+// ScheduleID identifies a recurring schedule registered with Instance.Schedule.
+type ScheduleID string
+
+var scheduleIDGenerator uint64
+
+func newScheduleID() ScheduleID {
+	return ScheduleID(fmt.Sprintf("%d", atomic.AddUint64(&scheduleIDGenerator, 1)))
+}
+
+// ScheduleSpec describes when and how often a scheduled Worker should run.
+// Exactly one of Every or Cron must be set.
+type ScheduleSpec struct {
+	// Every runs the worker on a fixed interval, k8s wait.Until-style: each
+	// wait is Every plus up to 10% jitter, so many schedules firing at once
+	// don't all collide on the same tick forever.
+	Every time.Duration
+	// Cron, if set instead of Every, is a 5-field cron expression
+	// ("MIN HOUR DOM MONTH DOW"). Only the minute and hour fields are
+	// currently interpreted; day-of-month, month and day-of-week must be
+	// "*", which is enough to express the common "every night at HH:MM"
+	// case. A full cron parser can replace this once we're willing to take
+	// the dependency.
+	Cron string
+
+	// MaxConcurrent caps how many runs of this schedule can be in flight at
+	// once. 0 means unlimited (bounded only by Instance.MaxConcurrentJobs).
+	MaxConcurrent int
+	// SkipIfRunning, if true, drops a tick entirely instead of starting a
+	// new run when a previous run from this schedule is still in progress.
+	SkipIfRunning bool
+	// RunOnStart, if true, fires the schedule once immediately instead of
+	// waiting for the first tick.
+	RunOnStart bool
+}
+
+// schedule is the runtime state behind a ScheduleID.
+type schedule struct {
+	id   ScheduleID
+	spec ScheduleSpec
+	// factory builds the Worker for one run. It takes the wrangler that run
+	// should use, rather than closing over a shared one, so that two
+	// overlapping runs of the same schedule (MaxConcurrent > 1, or
+	// RunOnStart firing alongside a tick) each get their own; see
+	// setAndStartWorker for why sharing one is unsafe.
+	factory func(wr *wrangler.Wrangler) Worker
+	cancel  context.CancelFunc
+
+	mu         sync.Mutex
+	activeRuns int
+	lastRun    time.Time
+	lastError  error
+	nextRun    time.Time
+}
+
+// Schedule registers factory to be run periodically according to spec, and
+// starts its scheduling loop in the background. factory is called once per
+// run with a wrangler dedicated to that run (see setAndStartWorker); it
+// must build its Worker with that wrangler rather than one of its own, or
+// concurrent runs of this schedule will race on it. The returned
+// ScheduleID can be used to look up its run history via ScheduleStatus, or
+// cancelled via CancelSchedule.
+func (wi *Instance) Schedule(spec ScheduleSpec, factory func(wr *wrangler.Wrangler) Worker) (ScheduleID, error) {
+	if (spec.Every <= 0) == (spec.Cron == "") {
+		return "", fmt.Errorf("exactly one of ScheduleSpec.Every or ScheduleSpec.Cron must be set")
+	}
+	if spec.Cron != "" {
+		if _, _, err := parseMinuteHourCron(spec.Cron); err != nil {
+			return "", err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &schedule{
+		id:      newScheduleID(),
+		spec:    spec,
+		factory: factory,
+		cancel:  cancel,
+	}
+
+	wi.mu.Lock()
+	if wi.schedules == nil {
+		wi.schedules = make(map[ScheduleID]*schedule)
+	}
+	wi.schedules[s.id] = s
+	wi.mu.Unlock()
+
+	go wi.runSchedule(ctx, s)
+	return s.id, nil
+}
+
+// CancelSchedule stops the scheduling loop for id. Any run already in
+// flight keeps going; it just won't be followed by another tick.
+func (wi *Instance) CancelSchedule(id ScheduleID) error {
+	wi.mu.Lock()
+	s, ok := wi.schedules[id]
+	wi.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: schedule %v", ErrNoWorker, id)
+	}
+	s.cancel()
+	return nil
+}
+
+// runSchedule is the scheduling loop for a single schedule. It mirrors k8s
+// wait.Until: a single timer, reset after each tick (rather than a fixed-
+// rate ticker), so a slow or skipped run never produces a backlog of
+// queued-up ticks.
+func (wi *Instance) runSchedule(ctx context.Context, s *schedule) {
+	if s.spec.RunOnStart {
+		wi.fireSchedule(s)
+	}
+	for {
+		wait := nextWait(s.spec)
+		s.mu.Lock()
+		s.nextRun = time.Now().Add(wait)
+		s.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+			wi.fireSchedule(s)
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// nextWait returns how long runSchedule should wait before the next tick.
+func nextWait(spec ScheduleSpec) time.Duration {
+	if spec.Every > 0 {
+		jitter := time.Duration(rand.Int63n(int64(spec.Every)/10 + 1))
+		return spec.Every + jitter
+	}
+	minute, hour, _ := parseMinuteHourCron(spec.Cron)
+	now := time.Now()
+	next := time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, now.Location())
+	if !next.After(now) {
+		next = next.Add(24 * time.Hour)
+	}
+	return next.Sub(now)
+}
+
+// fireSchedule starts one run of s.factory, subject to SkipIfRunning and
+// MaxConcurrent, and records the outcome in s once it completes.
+func (wi *Instance) fireSchedule(s *schedule) {
+	s.mu.Lock()
+	if s.spec.SkipIfRunning && s.activeRuns > 0 {
+		s.mu.Unlock()
+		log.Infof("Schedule %v: skipping tick, a run is still in progress", s.id)
+		return
+	}
+	if s.spec.MaxConcurrent > 0 && s.activeRuns >= s.spec.MaxConcurrent {
+		s.mu.Unlock()
+		log.Infof("Schedule %v: skipping tick, already at MaxConcurrent=%v", s.id, s.spec.MaxConcurrent)
+		return
+	}
+	s.activeRuns++
+	s.mu.Unlock()
+
+	// wi.wr is a placeholder here: setAndStartWorker swaps it for a fresh
+	// wrangler (via Instance.CreateWrangler) before invoking s.factory, so
+	// each run - and each concurrent run of the same schedule - gets its
+	// own wrangler instead of racing on a shared one.
+	jobID, done, err := wi.setAndStartWorker(s.factory, wi.wr)
+	if err != nil {
+		s.mu.Lock()
+		s.activeRuns--
+		s.lastRun = time.Now()
+		s.lastError = err
+		s.mu.Unlock()
+		log.Errorf("Schedule %v: failed to start worker: %v", s.id, err)
+		return
+	}
+
+	wi.mu.Lock()
+	j := wi.jobs.byID[jobID]
+	wi.mu.Unlock()
+
+	go func() {
+		<-done
+		s.mu.Lock()
+		s.activeRuns--
+		s.lastRun = time.Now()
+		s.lastError = nil
+		if j != nil {
+			s.lastError = j.lastRunError
+		}
+		s.mu.Unlock()
+	}()
+}
+
+// ScheduleStatus is a point-in-time snapshot of a schedule's run history.
+type ScheduleStatus struct {
+	ID         ScheduleID
+	Spec       ScheduleSpec
+	ActiveRuns int
+	LastRun    time.Time
+	LastError  error
+	NextRun    time.Time
+}
+
+// MarshalJSON renders LastError as a plain string; see JobStatus.MarshalJSON
+// for why the error interface can't be marshalled directly.
+func (ss *ScheduleStatus) MarshalJSON() ([]byte, error) {
+	type scheduleStatusAlias ScheduleStatus
+	aux := struct {
+		*scheduleStatusAlias
+		LastError string `json:",omitempty"`
+	}{scheduleStatusAlias: (*scheduleStatusAlias)(ss)}
+	if ss.LastError != nil {
+		aux.LastError = ss.LastError.Error()
+	}
+	return json.Marshal(aux)
+}
+
+// ScheduleStatus returns a snapshot of the schedule identified by id.
+func (wi *Instance) ScheduleStatus(id ScheduleID) (*ScheduleStatus, error) {
+	wi.mu.Lock()
+	s, ok := wi.schedules[id]
+	wi.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: schedule %v", ErrNoWorker, id)
+	}
+	return scheduleStatus(s), nil
+}
+
+// Schedules returns a snapshot of every schedule currently registered.
+func (wi *Instance) Schedules() []*ScheduleStatus {
+	wi.mu.Lock()
+	schedules := make([]*schedule, 0, len(wi.schedules))
+	for _, s := range wi.schedules {
+		schedules = append(schedules, s)
+	}
+	wi.mu.Unlock()
+
+	statuses := make([]*ScheduleStatus, 0, len(schedules))
+	for _, s := range schedules {
+		statuses = append(statuses, scheduleStatus(s))
+	}
+	return statuses
+}
+
+func scheduleStatus(s *schedule) *ScheduleStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &ScheduleStatus{
+		ID:         s.id,
+		Spec:       s.spec,
+		ActiveRuns: s.activeRuns,
+		LastRun:    s.lastRun,
+		LastError:  s.lastError,
+		NextRun:    s.nextRun,
+	}
+}
+
+// parseMinuteHourCron parses the minute and hour fields of a 5-field cron
+// expression, requiring the remaining three fields to be "*". It returns an
+// error for anything else, rather than silently ignoring unsupported
+// expressions.
+func parseMinuteHourCron(expr string) (minute, hour int, err error) {
+	var rest [3]string
+	n, err := fmt.Sscanf(expr, "%d %d %s %s %s", &minute, &hour, &rest[0], &rest[1], &rest[2])
+	if err != nil || n != 5 {
+		return 0, 0, fmt.Errorf("unsupported cron expression %q: only \"MIN HOUR * * *\" is supported", expr)
+	}
+	for _, f := range rest {
+		if f != "*" {
+			return 0, 0, fmt.Errorf("unsupported cron expression %q: day-of-month/month/day-of-week must be \"*\"", expr)
+		}
+	}
+	if minute < 0 || minute > 59 || hour < 0 || hour > 23 {
+		return 0, 0, fmt.Errorf("invalid cron expression %q: minute/hour out of range", expr)
+	}
+	return minute, hour, nil
+}
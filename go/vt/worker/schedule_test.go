@@ -0,0 +1,228 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package worker
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/youtube/vitess/go/vt/wrangler"
+)
+
+// waitFor polls cond until it returns true or the deadline passes, to avoid
+// flaking on the scheduler's background goroutines without hard-coding
+// sleeps that would make the test slow.
+func waitFor(t *testing.T, deadline time.Duration, cond func() bool) {
+	t.Helper()
+	end := time.Now().Add(deadline)
+	for time.Now().Before(end) {
+		if cond() {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if !cond() {
+		t.Fatalf("condition not met within %v", deadline)
+	}
+}
+
+func TestFireSchedule_RunOnStart(t *testing.T) {
+	wi := newTestInstance()
+
+	var mu sync.Mutex
+	runs := 0
+	wrk := newFakeWorker()
+	close(wrk.done)
+
+	id, err := wi.Schedule(ScheduleSpec{Every: time.Hour, RunOnStart: true}, func(wr *wrangler.Wrangler) Worker {
+		mu.Lock()
+		runs++
+		mu.Unlock()
+		return wrk
+	})
+	if err != nil {
+		t.Fatalf("Schedule failed: %v", err)
+	}
+	defer wi.CancelSchedule(id)
+
+	waitFor(t, time.Second, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return runs == 1
+	})
+}
+
+func TestFireSchedule_SkipIfRunning(t *testing.T) {
+	wi := newTestInstance()
+	wi.MaxConcurrentJobs = 2
+
+	wrk := newFakeWorker()
+	s := &schedule{
+		id:      newScheduleID(),
+		spec:    ScheduleSpec{Every: time.Hour, SkipIfRunning: true},
+		factory: func(wr *wrangler.Wrangler) Worker { return wrk },
+	}
+
+	wi.fireSchedule(s)
+	waitFor(t, time.Second, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.activeRuns == 1
+	})
+
+	// The worker is still blocked, so this tick should be skipped rather
+	// than starting a second overlapping run.
+	wi.fireSchedule(s)
+	s.mu.Lock()
+	activeRuns := s.activeRuns
+	s.mu.Unlock()
+	if activeRuns != 1 {
+		t.Fatalf("expected SkipIfRunning tick to be a no-op, got activeRuns=%v", activeRuns)
+	}
+
+	close(wrk.done)
+	waitFor(t, time.Second, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.activeRuns == 0
+	})
+}
+
+func TestFireSchedule_MaxConcurrent(t *testing.T) {
+	wi := newTestInstance()
+	wi.MaxConcurrentJobs = 5
+
+	var mu sync.Mutex
+	var started []*fakeWorker
+	s := &schedule{
+		id:   newScheduleID(),
+		spec: ScheduleSpec{Every: time.Hour, MaxConcurrent: 2},
+		factory: func(wr *wrangler.Wrangler) Worker {
+			wrk := newFakeWorker()
+			mu.Lock()
+			started = append(started, wrk)
+			mu.Unlock()
+			return wrk
+		},
+	}
+
+	wi.fireSchedule(s)
+	wi.fireSchedule(s)
+	waitFor(t, time.Second, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.activeRuns == 2
+	})
+
+	// A third tick should be dropped: MaxConcurrent is already saturated.
+	wi.fireSchedule(s)
+	time.Sleep(10 * time.Millisecond)
+	mu.Lock()
+	numStarted := len(started)
+	mu.Unlock()
+	if numStarted != 2 {
+		t.Fatalf("expected MaxConcurrent=2 to cap started runs at 2, got %v", numStarted)
+	}
+
+	mu.Lock()
+	for _, wrk := range started {
+		close(wrk.done)
+	}
+	mu.Unlock()
+	waitFor(t, time.Second, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.activeRuns == 0
+	})
+}
+
+func TestFireSchedule_EachRunGetsItsOwnWrangler(t *testing.T) {
+	wi := newTestInstance()
+	wi.MaxConcurrentJobs = 5
+
+	seen := make(chan *wrangler.Wrangler, 2)
+	s := &schedule{
+		id:   newScheduleID(),
+		spec: ScheduleSpec{Every: time.Hour, MaxConcurrent: 2},
+		factory: func(wr *wrangler.Wrangler) Worker {
+			if wr == wi.wr {
+				t.Errorf("scheduled run was handed the shared default wrangler directly")
+			}
+			seen <- wr
+			wrk := newFakeWorker()
+			close(wrk.done)
+			return wrk
+		},
+	}
+
+	wi.fireSchedule(s)
+	wi.fireSchedule(s)
+
+	first := <-seen
+	second := <-seen
+	if first == second {
+		t.Fatalf("two concurrent runs of the same schedule were given the same *wrangler.Wrangler")
+	}
+}
+
+func TestFireSchedule_RecordsOutcome(t *testing.T) {
+	wi := newTestInstance()
+	wi.MaxConcurrentJobs = 1
+
+	// Saturate the Instance so setAndStartWorker fails and fireSchedule has
+	// to record that failure as s.lastError.
+	blocking := newFakeWorker()
+	if _, _, err := wi.setAndStartWorker(func(wr *wrangler.Wrangler) Worker { return blocking }, wi.wr); err != nil {
+		t.Fatalf("setup job failed to start: %v", err)
+	}
+	defer close(blocking.done)
+
+	s := &schedule{
+		id:      newScheduleID(),
+		spec:    ScheduleSpec{Every: time.Hour},
+		factory: func(wr *wrangler.Wrangler) Worker { return newFakeWorker() },
+	}
+	wi.fireSchedule(s)
+
+	s.mu.Lock()
+	lastError := s.lastError
+	s.mu.Unlock()
+	if !errors.Is(lastError, ErrWorkerAlreadyRunning) {
+		t.Fatalf("expected fireSchedule to record ErrWorkerAlreadyRunning, got %v", lastError)
+	}
+}
+
+func TestParseMinuteHourCron(t *testing.T) {
+	tests := []struct {
+		expr       string
+		wantMinute int
+		wantHour   int
+		wantErr    bool
+	}{
+		{expr: "30 4 * * *", wantMinute: 30, wantHour: 4},
+		{expr: "0 0 * * *", wantMinute: 0, wantHour: 0},
+		{expr: "60 4 * * *", wantErr: true},
+		{expr: "30 4 1 * *", wantErr: true},
+		{expr: "not a cron", wantErr: true},
+	}
+	for _, tt := range tests {
+		minute, hour, err := parseMinuteHourCron(tt.expr)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseMinuteHourCron(%q): expected an error, got none", tt.expr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseMinuteHourCron(%q): unexpected error: %v", tt.expr, err)
+			continue
+		}
+		if minute != tt.wantMinute || hour != tt.wantHour {
+			t.Errorf("parseMinuteHourCron(%q) = %v, %v; want %v, %v", tt.expr, minute, hour, tt.wantMinute, tt.wantHour)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2015, Google Inc. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package workerinfo provides a small structured-status reporting facility
+// used by vtworker's Worker implementations (SplitClone, VerticalSplitClone,
+// SplitDiff, ...) to publish their runtime state, instead of relying solely
+// on free-form log lines through a MemoryLogger. It's modeled after the
+// worker-info system in portmaster.
+package workerinfo
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultLogTailLen bounds how many recent log lines a StatusReporter keeps
+// around for Snapshot().Log.
+const defaultLogTailLen = 100
+
+// StatusReporter is the handle a Worker uses to publish structured status
+// as it runs. It is safe for concurrent use.
+type StatusReporter struct {
+	// stallTimeout, if non-zero, is the maximum time allowed between two
+	// Heartbeat() calls before Snapshot reports Stalled.
+	stallTimeout time.Duration
+
+	mu         sync.Mutex
+	stage      string
+	stageStart time.Time
+	done       int64
+	total      int64
+	goroutines int
+	labels     map[string]string
+	lastBeat   time.Time
+
+	logMu   sync.Mutex
+	logTail []string
+}
+
+// New creates a StatusReporter. A stallTimeout of 0 disables stall
+// detection.
+func New(stallTimeout time.Duration) *StatusReporter {
+	return &StatusReporter{
+		stallTimeout: stallTimeout,
+		labels:       make(map[string]string),
+		lastBeat:     time.Now(),
+	}
+}
+
+// SetStage records the name of the phase the worker is currently in, e.g.
+// "copy", "diff", "verify", and resets progress tracking for it.
+func (r *StatusReporter) SetStage(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stage = name
+	r.stageStart = time.Now()
+	r.done, r.total = 0, 0
+	r.lastBeat = time.Now()
+}
+
+// SetProgress updates how far through the current stage the worker is.
+func (r *StatusReporter) SetProgress(done, total int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.done, r.total = done, total
+	r.lastBeat = time.Now()
+}
+
+// Heartbeat records that the worker is still alive, even if its stage or
+// progress haven't changed. Long-running, hard-to-instrument calls (e.g. a
+// mysqlctl RPC during clone) should call this periodically so a stall alarm
+// can fire if they get stuck.
+func (r *StatusReporter) Heartbeat() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastBeat = time.Now()
+}
+
+// SetGoroutines records how many goroutines the worker's own errgroup
+// currently has in flight, surfaced by Snapshot as Status.Goroutines.
+func (r *StatusReporter) SetGoroutines(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.goroutines = n
+}
+
+// AttachLabels merges the given labels into the reporter's label set, e.g.
+// {"keyspace": "user", "shard": "-80"}.
+func (r *StatusReporter) AttachLabels(labels map[string]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for k, v := range labels {
+		r.labels[k] = v
+	}
+}
+
+// Log appends a line to the reporter's tail of recent log entries, returned
+// by Snapshot().Log.
+func (r *StatusReporter) Log(line string) {
+	r.logMu.Lock()
+	defer r.logMu.Unlock()
+	r.logTail = append(r.logTail, line)
+	if len(r.logTail) > defaultLogTailLen {
+		r.logTail = r.logTail[len(r.logTail)-defaultLogTailLen:]
+	}
+}
+
+// Status is a point-in-time snapshot of a StatusReporter, safe to marshal
+// to JSON or copy into a gRPC response.
+type Status struct {
+	Stage   string
+	Done    int64
+	Total   int64
+	Percent float64
+	// ETA is the estimated completion time of the current stage, computed
+	// from the done/total ratio and the rate observed since SetStage was
+	// last called. It is the zero time if there isn't enough data yet.
+	ETA        time.Time
+	Labels     map[string]string
+	Goroutines int
+	Log        []string
+	Stalled    bool
+	LastBeat   time.Time
+}
+
+// Snapshot returns the current status, including whatever goroutine count
+// was last reported via SetGoroutines (0 if the worker never called it).
+func (r *StatusReporter) Snapshot() *Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := &Status{
+		Stage:      r.stage,
+		Done:       r.done,
+		Total:      r.total,
+		Labels:     make(map[string]string, len(r.labels)),
+		Goroutines: r.goroutines,
+		LastBeat:   r.lastBeat,
+	}
+	for k, v := range r.labels {
+		s.Labels[k] = v
+	}
+
+	if r.total > 0 {
+		s.Percent = 100 * float64(r.done) / float64(r.total)
+		if r.done > 0 {
+			elapsed := time.Since(r.stageStart)
+			rate := float64(r.done) / elapsed.Seconds()
+			if rate > 0 {
+				remaining := float64(r.total-r.done) / rate
+				s.ETA = time.Now().Add(time.Duration(remaining) * time.Second)
+			}
+		}
+	}
+	if r.stallTimeout > 0 && time.Since(r.lastBeat) > r.stallTimeout {
+		s.Stalled = true
+	}
+
+	r.logMu.Lock()
+	s.Log = append([]string{}, r.logTail...)
+	r.logMu.Unlock()
+
+	return s
+}